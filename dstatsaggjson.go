@@ -57,6 +57,7 @@ import (
     "fmt"
     "log"
     "io"
+    "math/big"
     "os"
     "reflect"
     "strings"
@@ -65,6 +66,20 @@ import (
 type Ctx struct {
     Delimiter string
     Data map[string]map[string]interface{}
+    BigNum bool
+    BigFloatPrec int
+}
+
+// BigFloat wraps *big.Float so aggregated floating-point sums can be
+// serialized as a plain JSON number (big.Float has no MarshalJSON of
+// its own) with a configurable number of digits after the point.
+type BigFloat struct {
+    *big.Float
+    Prec int
+}
+
+func (b BigFloat) MarshalJSON() ([]byte, error) {
+    return []byte(b.Float.Text('f', b.Prec)), nil
 }
 
 func main() {
@@ -72,6 +87,8 @@ func main() {
         delimiter string
         outfile string
         writer io.Writer
+        big_num bool
+        big_float_prec int
     )
 
     flag.Usage = func() {
@@ -83,6 +100,12 @@ func main() {
 
     flag.StringVar(&delimiter, "del", "\t", "Alternate delimiter between key and JSON object")
     flag.StringVar(&outfile, "outfile", "", "Output file (defaults to standard output)")
+    flag.BoolVar(&big_num, "bignum", false, "Aggregate integers as"+
+        " math/big.Int and floats as math/big.Float instead of"+
+        " int64/uint64/float64, to avoid overflow or precision loss"+
+        " when summing large counters")
+    flag.IntVar(&big_float_prec, "bigprec", 6, "Number of digits after"+
+        " the decimal point to emit for -bignum float sums")
     flag.Parse()
 
     if outfile == "" {
@@ -100,6 +123,8 @@ func main() {
     ctx := new(Ctx)
     ctx.Delimiter = delimiter
     ctx.Data = make(map[string]map[string]interface{})
+    ctx.BigNum = big_num
+    ctx.BigFloatPrec = big_float_prec
 
     files := flag.Args()
     if len(files) == 0 {
@@ -132,10 +157,21 @@ func process_file(ctx *Ctx, reader io.Reader) {
                 len(parts), line)
         }
         this_data := make(map[string]interface{})
-        err := json.Unmarshal([]byte(parts[1]), &this_data)
-        if err != nil {
-            log.Printf("couldn't parse JSON object '%s': %s", parts[1], err)
-            continue
+        if ctx.BigNum {
+            dec := json.NewDecoder(strings.NewReader(parts[1]))
+            dec.UseNumber()
+            err := dec.Decode(&this_data)
+            if err != nil {
+                log.Printf("couldn't parse JSON object '%s': %s", parts[1], err)
+                continue
+            }
+            normalize_bignum(this_data, ctx.BigFloatPrec)
+        } else {
+            err := json.Unmarshal([]byte(parts[1]), &this_data)
+            if err != nil {
+                log.Printf("couldn't parse JSON object '%s': %s", parts[1], err)
+                continue
+            }
         }
 
         stored_val, ok := data[parts[0]]
@@ -176,6 +212,16 @@ func process_file(ctx *Ctx, reader io.Reader) {
                 continue
             }
 
+            if ctx.BigNum {
+                sum, err := add_bignum(ov, nv, ctx.BigFloatPrec)
+                if err != nil {
+                    log.Printf("couldn't aggregate: %s", err)
+                    continue
+                }
+                stored_val[nk] = sum
+                continue
+            }
+
             if ov_is_int && nv_is_int {
                 if nv_is_signed == ov_is_signed {
                     if nv_is_signed {
@@ -254,9 +300,115 @@ func is_num_type(v reflect.Value) (bool, bool, bool) {
         return true, false, true
     }
 
+    if v.IsValid() {
+        switch v.Interface().(type) {
+        case json.Number, *big.Int, BigFloat:
+            // Arbitrary-precision values are numeric, but don't map
+            // to a fixed-width int/float kind, so is_int/is_signed
+            // are meaningless here; add_bignum does the real dispatch.
+            return true, false, false
+        }
+    }
+
     return false, false, false
 }
 
+// to_bignum converts a decoded JSON numeric value into a *big.Int or
+// BigFloat, preferring *big.Int whenever the value parses as an
+// integer so that integer sums stay exact.
+func to_bignum(v interface{}, prec int) (interface{}, error) {
+    switch n := v.(type) {
+    case *big.Int:
+        return n, nil
+    case BigFloat:
+        return n, nil
+    case json.Number:
+        s := n.String()
+        if !strings.ContainsAny(s, ".eE") {
+            if i, ok := new(big.Int).SetString(s, 10); ok {
+                return i, nil
+            }
+        }
+        f, _, err := big.ParseFloat(s, 10, 0, big.ToNearestEven)
+        if err != nil {
+            return nil, fmt.Errorf("couldn't parse '%s' as a number: %s", s, err)
+        }
+        return BigFloat{f, prec}, nil
+    case int64:
+        return big.NewInt(n), nil
+    case uint64:
+        return new(big.Int).SetUint64(n), nil
+    case float64:
+        return BigFloat{big.NewFloat(n), prec}, nil
+    }
+
+    return nil, fmt.Errorf("unsupported type %T for -bignum aggregation", v)
+}
+
+// add_bignum sums two numeric values using arbitrary precision,
+// promoting the result to BigFloat if either operand is non-integral.
+func add_bignum(ov, nv interface{}, prec int) (interface{}, error) {
+    ov_big, err := to_bignum(ov, prec)
+    if err != nil {
+        return nil, err
+    }
+    nv_big, err := to_bignum(nv, prec)
+    if err != nil {
+        return nil, err
+    }
+
+    ov_int, ov_is_int := ov_big.(*big.Int)
+    nv_int, nv_is_int := nv_big.(*big.Int)
+
+    if ov_is_int && nv_is_int {
+        return new(big.Int).Add(ov_int, nv_int), nil
+    }
+
+    return BigFloat{new(big.Float).Add(to_big_float(ov_big), to_big_float(nv_big)), prec}, nil
+}
+
+func to_big_float(v interface{}) *big.Float {
+    switch n := v.(type) {
+    case *big.Int:
+        return new(big.Float).SetInt(n)
+    case BigFloat:
+        return n.Float
+    }
+
+    return new(big.Float)
+}
+
+// normalize_bignum walks a freshly-decoded (UseNumber) record,
+// replacing json.Number leaves with *big.Int/BigFloat so later
+// aggregation rounds operate on arbitrary-precision values directly
+// instead of re-parsing the original string each time.
+func normalize_bignum(m map[string]interface{}, prec int) {
+    for k, v := range m {
+        m[k] = normalize_bignum_value(v, prec)
+    }
+}
+
+func normalize_bignum_value(v interface{}, prec int) interface{} {
+    switch t := v.(type) {
+    case json.Number:
+        n, err := to_bignum(t, prec)
+        if err != nil {
+            return v
+        }
+        return n
+    case map[string]interface{}:
+        normalize_bignum(t, prec)
+        return t
+    case []interface{}:
+        for i, e := range t {
+            t[i] = normalize_bignum_value(e, prec)
+        }
+        return t
+    }
+
+    return v
+}
+
 func write_data(ctx *Ctx, writer io.Writer) {
     out_delimiter := "\t"
     for k,v := range ctx.Data {
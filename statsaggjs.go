@@ -62,23 +62,1233 @@ package main
 
 import (
     "bufio"
+    "compress/gzip"
+    "container/heap"
+    "encoding/binary"
     "encoding/json"
     "flag"
     "fmt"
+    "hash/fnv"
     "log"
     "io"
+    "math"
+    "math/big"
     "os"
     "reflect"
     "sort"
+    "strconv"
     "strings"
+    "sync"
 )
 
 type Ctx struct {
     Delimiter string
     Limit int
-    Data map[string]map[string]interface{}
+    // Data holds one map per shard; sequential runs (the default) use
+    // a single shard, while -parallel N partitions keys across N of
+    // them, one per worker goroutine, to avoid locking.
+    Data []map[string]map[string]interface{}
     Writer io.Writer
     SortOutput bool
+    BigNum bool
+    BigFloatPrec int
+    Policy *Policy
+    TmpDir string
+    MaxRuns int
+    RunFiles []string
+    Parallel int
+    // InCodec/OutCodec control the wire format read from input files
+    // and written to output, selected via -format/-outformat. They
+    // default to tsv-json, the tool's original format.
+    InCodec Codec
+    OutCodec Codec
+    KeyField string
+}
+
+// BigFloat wraps *big.Float so aggregated floating-point sums can be
+// serialized as a plain JSON number (big.Float has no MarshalJSON of
+// its own) with a configurable number of digits after the point.
+type BigFloat struct {
+    *big.Float
+    Prec int
+}
+
+func (b BigFloat) MarshalJSON() ([]byte, error) {
+    return []byte(b.Float.Text('f', b.Prec)), nil
+}
+
+// Codec reads and writes one record at a time in a specific wire
+// format, so process_file and write_data can be driven by whichever
+// -format/-outformat the caller selected instead of being hardcoded to
+// the tab-delimited "key\t{json}" layout. ReadRecord returns io.EOF
+// (unwrapped) once the stream is exhausted.
+type Codec interface {
+    ReadRecord(r *bufio.Reader) (key string, obj map[string]interface{}, err error)
+    WriteRecord(w io.Writer, key string, obj map[string]interface{}) error
+}
+
+// codec_for builds the named Codec, sharing ctx so the tsv-json and
+// ndjson codecs can honor -bignum the same way decode_record already
+// does.
+func codec_for(name string, ctx *Ctx) (Codec, error) {
+    switch name {
+    case "", "tsv-json":
+        return &TSVJSONCodec{Ctx: ctx, Delimiter: ctx.Delimiter}, nil
+    case "ndjson":
+        return &NDJSONCodec{Ctx: ctx, KeyField: ctx.KeyField, KeyFieldPath: compile_policy_path(ctx.KeyField)}, nil
+    case "msgpack":
+        return &MsgpackCodec{Ctx: ctx}, nil
+    case "preserves":
+        return &PreservesCodec{Ctx: ctx}, nil
+    }
+
+    return nil, fmt.Errorf("unknown -format/-outformat %q (want tsv-json, ndjson, msgpack, or preserves)", name)
+}
+
+// TSVJSONCodec is the tool's original format: one record per line, a
+// key, Delimiter, and a JSON object.
+type TSVJSONCodec struct {
+    Ctx *Ctx
+    Delimiter string
+}
+
+func (c *TSVJSONCodec) ReadRecord(r *bufio.Reader) (string, map[string]interface{}, error) {
+    line, err := read_line(r)
+    if err != nil {
+        return "", nil, err
+    }
+
+    parts := strings.SplitN(line, c.Delimiter, 2)
+    if len(parts) < 2 {
+        return "", nil, &fatal_record_error{fmt.Sprintf(
+            "wrong number of fields: %d: '%s'", len(parts), line)}
+    }
+
+    obj, err := decode_record(c.Ctx, parts[1])
+    if err != nil {
+        return "", nil, fmt.Errorf("couldn't parse JSON object '%s': %s", parts[1], err)
+    }
+
+    return parts[0], obj, nil
+}
+
+func (c *TSVJSONCodec) WriteRecord(w io.Writer, key string, obj map[string]interface{}) error {
+    serialized, err := json.Marshal(obj)
+    if err != nil {
+        return err
+    }
+
+    _, err = fmt.Fprintf(w, "%s\t%s\n", key, serialized)
+    return err
+}
+
+// NDJSONCodec stores one full JSON object per line, with the record's
+// key embedded at KeyFieldPath (e.g. "$.user.id") instead of living
+// alongside the object. ReadRecord removes the key field from the
+// decoded object before returning it, and WriteRecord adds it back in.
+type NDJSONCodec struct {
+    Ctx *Ctx
+    KeyField string
+    KeyFieldPath []string
+}
+
+func (c *NDJSONCodec) ReadRecord(r *bufio.Reader) (string, map[string]interface{}, error) {
+    var line string
+    for {
+        l, err := read_line(r)
+        if err != nil {
+            return "", nil, err
+        }
+        if strings.TrimSpace(l) != "" {
+            line = l
+            break
+        }
+    }
+
+    obj, err := decode_record(c.Ctx, line)
+    if err != nil {
+        return "", nil, fmt.Errorf("couldn't parse NDJSON object '%s': %s", line, err)
+    }
+
+    raw_key, ok := get_and_remove_path(obj, c.KeyFieldPath)
+    if !ok {
+        return "", nil, fmt.Errorf("key field %q not found in record '%s'", c.KeyField, line)
+    }
+
+    return fmt.Sprintf("%v", raw_key), obj, nil
+}
+
+func (c *NDJSONCodec) WriteRecord(w io.Writer, key string, obj map[string]interface{}) error {
+    set_path_value(obj, c.KeyFieldPath, key)
+
+    serialized, err := json.Marshal(obj)
+    if err != nil {
+        return err
+    }
+
+    _, err = fmt.Fprintf(w, "%s\n", serialized)
+    return err
+}
+
+// get_and_remove_path navigates obj along path, returning and deleting
+// the leaf value if every segment but the last names a nested map.
+func get_and_remove_path(obj map[string]interface{}, path []string) (interface{}, bool) {
+    if len(path) == 0 {
+        return nil, false
+    }
+
+    m := obj
+    for _, seg := range path[:len(path)-1] {
+        next, ok := m[seg].(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+        m = next
+    }
+
+    leaf := path[len(path)-1]
+    v, ok := m[leaf]
+    if ok {
+        delete(m, leaf)
+    }
+    return v, ok
+}
+
+// set_path_value navigates obj along path, creating nested maps as
+// needed, and sets the leaf value.
+func set_path_value(obj map[string]interface{}, path []string, value interface{}) {
+    if len(path) == 0 {
+        return
+    }
+
+    m := obj
+    for _, seg := range path[:len(path)-1] {
+        next, ok := m[seg].(map[string]interface{})
+        if !ok {
+            next = make(map[string]interface{})
+            m[seg] = next
+        }
+        m = next
+    }
+
+    m[path[len(path)-1]] = value
+}
+
+// fatal_record_error marks a ReadRecord failure severe enough that the
+// caller should abort the whole run instead of logging and skipping
+// the record, matching the tool's original behavior when a tsv-json
+// line had the wrong number of fields.
+type fatal_record_error struct {
+    msg string
+}
+
+func (e *fatal_record_error) Error() string { return e.msg }
+
+// log_read_err logs a ReadRecord error, aborting the run via
+// log.Fatalf when it's a *fatal_record_error.
+func log_read_err(err error) {
+    if _, fatal := err.(*fatal_record_error); fatal {
+        log.Fatalf("couldn't read record: %s", err)
+    }
+    log.Printf("couldn't read record: %s", err)
+}
+
+// read_line reads one newline-delimited line from r, stripping the
+// trailing "\r\n"/"\n". A final line with no trailing newline is
+// returned with a nil error; the next call then returns io.EOF.
+func read_line(r *bufio.Reader) (string, error) {
+    line, err := r.ReadString('\n')
+    if len(line) == 0 && err != nil {
+        return "", err
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
+
+// MsgpackCodec implements Codec using a minimal, hand-rolled
+// MessagePack encoder/decoder covering the subset of types aggregate
+// produces: nil, bool, string, signed and unsigned integers, float64,
+// arrays, and string-keyed maps. A full third-party implementation
+// (e.g. vmihailenco/msgpack) isn't available since this tree has no
+// go.mod/vendored modules. Each record is two consecutive MessagePack
+// values -- a string key followed by a map object -- with no extra
+// outer framing, since MessagePack values are already self-delimiting.
+type MsgpackCodec struct {
+    Ctx *Ctx
+}
+
+func (c *MsgpackCodec) ReadRecord(r *bufio.Reader) (string, map[string]interface{}, error) {
+    key_val, err := msgpack_decode(r)
+    if err != nil {
+        return "", nil, err
+    }
+    key, ok := key_val.(string)
+    if !ok {
+        return "", nil, fmt.Errorf("expected a string key, got %T", key_val)
+    }
+
+    obj_val, err := msgpack_decode(r)
+    if err != nil {
+        return "", nil, err
+    }
+    obj, ok := obj_val.(map[string]interface{})
+    if !ok {
+        return "", nil, fmt.Errorf("expected a map object, got %T", obj_val)
+    }
+
+    return key, obj, nil
+}
+
+func (c *MsgpackCodec) WriteRecord(w io.Writer, key string, obj map[string]interface{}) error {
+    if err := msgpack_encode(w, key); err != nil {
+        return err
+    }
+    return msgpack_encode(w, obj)
+}
+
+func msgpack_encode(w io.Writer, v interface{}) error {
+    switch val := v.(type) {
+    case nil:
+        _, err := w.Write([]byte{0xc0})
+        return err
+    case bool:
+        b := byte(0xc2)
+        if val {
+            b = 0xc3
+        }
+        _, err := w.Write([]byte{b})
+        return err
+    case string:
+        return msgpack_encode_string(w, val)
+    case int:
+        return msgpack_encode_int(w, int64(val))
+    case int64:
+        return msgpack_encode_int(w, val)
+    case uint64:
+        return msgpack_encode_uint(w, val)
+    case float64:
+        return msgpack_encode_float(w, val)
+    case json.Number:
+        f, err := val.Float64()
+        if err != nil {
+            return err
+        }
+        return msgpack_encode_float(w, f)
+    case *big.Int:
+        if val.IsInt64() {
+            return msgpack_encode_int(w, val.Int64())
+        }
+        if val.IsUint64() {
+            return msgpack_encode_uint(w, val.Uint64())
+        }
+        // MessagePack has no arbitrary-precision integer type, so a
+        // value outside the 64-bit range falls back to its decimal text.
+        return msgpack_encode_string(w, val.String())
+    case BigFloat:
+        f, _ := val.Float.Float64()
+        return msgpack_encode_float(w, f)
+    case map[string]interface{}:
+        return msgpack_encode_map(w, val)
+    case []interface{}:
+        return msgpack_encode_array(w, val)
+    }
+
+    if generic, ok, err := marshaler_to_generic(v); ok {
+        if err != nil {
+            return err
+        }
+        return msgpack_encode(w, generic)
+    }
+
+    return fmt.Errorf("unsupported type %T for msgpack encoding", v)
+}
+
+// marshaler_to_generic round-trips v through its own MarshalJSON (if
+// it implements json.Marshaler) into a plain nil/bool/string/float64/
+// map/slice value, so each codec's encoder only needs one fallback
+// for the accumulator types (*AvgAccumulator, etc.), which otherwise
+// only know how to serialize their final, collapsed user-facing view.
+// The second return value reports whether v implemented
+// json.Marshaler at all.
+func marshaler_to_generic(v interface{}) (interface{}, bool, error) {
+    m, ok := v.(json.Marshaler)
+    if !ok {
+        return nil, false, nil
+    }
+
+    data, err := m.MarshalJSON()
+    if err != nil {
+        return nil, true, err
+    }
+    var generic interface{}
+    if err := json.Unmarshal(data, &generic); err != nil {
+        return nil, true, err
+    }
+    return generic, true, nil
+}
+
+func msgpack_encode_string(w io.Writer, s string) error {
+    b := []byte(s)
+    n := len(b)
+
+    var hdr []byte
+    switch {
+    case n < 32:
+        hdr = []byte{0xa0 | byte(n)}
+    case n < 1<<8:
+        hdr = []byte{0xd9, byte(n)}
+    case n < 1<<16:
+        hdr = make([]byte, 3)
+        hdr[0] = 0xda
+        binary.BigEndian.PutUint16(hdr[1:], uint16(n))
+    default:
+        hdr = make([]byte, 5)
+        hdr[0] = 0xdb
+        binary.BigEndian.PutUint32(hdr[1:], uint32(n))
+    }
+
+    if _, err := w.Write(hdr); err != nil {
+        return err
+    }
+    _, err := w.Write(b)
+    return err
+}
+
+func msgpack_encode_int(w io.Writer, v int64) error {
+    switch {
+    case v >= 0 && v < 128:
+        _, err := w.Write([]byte{byte(v)})
+        return err
+    case v < 0 && v >= -32:
+        _, err := w.Write([]byte{0xe0 | (byte(v) & 0x1f)})
+        return err
+    case v >= math.MinInt8 && v <= math.MaxInt8:
+        _, err := w.Write([]byte{0xd0, byte(int8(v))})
+        return err
+    case v >= math.MinInt16 && v <= math.MaxInt16:
+        buf := make([]byte, 3)
+        buf[0] = 0xd1
+        binary.BigEndian.PutUint16(buf[1:], uint16(int16(v)))
+        _, err := w.Write(buf)
+        return err
+    case v >= math.MinInt32 && v <= math.MaxInt32:
+        buf := make([]byte, 5)
+        buf[0] = 0xd2
+        binary.BigEndian.PutUint32(buf[1:], uint32(int32(v)))
+        _, err := w.Write(buf)
+        return err
+    default:
+        buf := make([]byte, 9)
+        buf[0] = 0xd3
+        binary.BigEndian.PutUint64(buf[1:], uint64(v))
+        _, err := w.Write(buf)
+        return err
+    }
+}
+
+func msgpack_encode_uint(w io.Writer, v uint64) error {
+    switch {
+    case v < 1<<7:
+        _, err := w.Write([]byte{byte(v)})
+        return err
+    case v <= math.MaxUint8:
+        _, err := w.Write([]byte{0xcc, byte(v)})
+        return err
+    case v <= math.MaxUint16:
+        buf := make([]byte, 3)
+        buf[0] = 0xcd
+        binary.BigEndian.PutUint16(buf[1:], uint16(v))
+        _, err := w.Write(buf)
+        return err
+    case v <= math.MaxUint32:
+        buf := make([]byte, 5)
+        buf[0] = 0xce
+        binary.BigEndian.PutUint32(buf[1:], uint32(v))
+        _, err := w.Write(buf)
+        return err
+    default:
+        buf := make([]byte, 9)
+        buf[0] = 0xcf
+        binary.BigEndian.PutUint64(buf[1:], v)
+        _, err := w.Write(buf)
+        return err
+    }
+}
+
+func msgpack_encode_float(w io.Writer, f float64) error {
+    buf := make([]byte, 9)
+    buf[0] = 0xcb
+    binary.BigEndian.PutUint64(buf[1:], math.Float64bits(f))
+    _, err := w.Write(buf)
+    return err
+}
+
+func msgpack_encode_array(w io.Writer, a []interface{}) error {
+    n := len(a)
+
+    var hdr []byte
+    switch {
+    case n < 16:
+        hdr = []byte{0x90 | byte(n)}
+    case n < 1<<16:
+        hdr = make([]byte, 3)
+        hdr[0] = 0xdc
+        binary.BigEndian.PutUint16(hdr[1:], uint16(n))
+    default:
+        hdr = make([]byte, 5)
+        hdr[0] = 0xdd
+        binary.BigEndian.PutUint32(hdr[1:], uint32(n))
+    }
+
+    if _, err := w.Write(hdr); err != nil {
+        return err
+    }
+    for _, v := range a {
+        if err := msgpack_encode(w, v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func msgpack_encode_map(w io.Writer, m map[string]interface{}) error {
+    n := len(m)
+
+    var hdr []byte
+    switch {
+    case n < 16:
+        hdr = []byte{0x80 | byte(n)}
+    case n < 1<<16:
+        hdr = make([]byte, 3)
+        hdr[0] = 0xde
+        binary.BigEndian.PutUint16(hdr[1:], uint16(n))
+    default:
+        hdr = make([]byte, 5)
+        hdr[0] = 0xdf
+        binary.BigEndian.PutUint32(hdr[1:], uint32(n))
+    }
+
+    if _, err := w.Write(hdr); err != nil {
+        return err
+    }
+
+    // Sort keys so output is deterministic, matching encoding/json's
+    // own behavior when marshaling a map.
+    keys := make([]string, 0, n)
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        if err := msgpack_encode_string(w, k); err != nil {
+            return err
+        }
+        if err := msgpack_encode(w, m[k]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// msgpack_decode reads one MessagePack value from r, returning nil,
+// bool, string, int64, uint64, float64, []interface{}, or
+// map[string]interface{} depending on the type tag.
+func msgpack_decode(r io.Reader) (interface{}, error) {
+    tag, err := read_byte(r)
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case tag <= 0x7f:
+        return int64(tag), nil
+    case tag >= 0xe0:
+        return int64(int8(tag)), nil
+    case tag >= 0xa0 && tag <= 0xbf:
+        return msgpack_read_string(r, int(tag&0x1f))
+    case tag >= 0x90 && tag <= 0x9f:
+        return msgpack_read_array(r, int(tag&0x0f))
+    case tag >= 0x80 && tag <= 0x8f:
+        return msgpack_read_map(r, int(tag&0x0f))
+    }
+
+    switch tag {
+    case 0xc0:
+        return nil, nil
+    case 0xc2:
+        return false, nil
+    case 0xc3:
+        return true, nil
+    case 0xcc:
+        b, err := read_n(r, 1)
+        if err != nil {
+            return nil, err
+        }
+        return uint64(b[0]), nil
+    case 0xcd:
+        b, err := read_n(r, 2)
+        if err != nil {
+            return nil, err
+        }
+        return uint64(binary.BigEndian.Uint16(b)), nil
+    case 0xce:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return uint64(binary.BigEndian.Uint32(b)), nil
+    case 0xcf:
+        b, err := read_n(r, 8)
+        if err != nil {
+            return nil, err
+        }
+        return binary.BigEndian.Uint64(b), nil
+    case 0xd0:
+        b, err := read_n(r, 1)
+        if err != nil {
+            return nil, err
+        }
+        return int64(int8(b[0])), nil
+    case 0xd1:
+        b, err := read_n(r, 2)
+        if err != nil {
+            return nil, err
+        }
+        return int64(int16(binary.BigEndian.Uint16(b))), nil
+    case 0xd2:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return int64(int32(binary.BigEndian.Uint32(b))), nil
+    case 0xd3:
+        b, err := read_n(r, 8)
+        if err != nil {
+            return nil, err
+        }
+        return int64(binary.BigEndian.Uint64(b)), nil
+    case 0xca:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+    case 0xcb:
+        b, err := read_n(r, 8)
+        if err != nil {
+            return nil, err
+        }
+        return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+    case 0xd9:
+        b, err := read_n(r, 1)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_string(r, int(b[0]))
+    case 0xda:
+        b, err := read_n(r, 2)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_string(r, int(binary.BigEndian.Uint16(b)))
+    case 0xdb:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_string(r, int(binary.BigEndian.Uint32(b)))
+    case 0xdc:
+        b, err := read_n(r, 2)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_array(r, int(binary.BigEndian.Uint16(b)))
+    case 0xdd:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_array(r, int(binary.BigEndian.Uint32(b)))
+    case 0xde:
+        b, err := read_n(r, 2)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_map(r, int(binary.BigEndian.Uint16(b)))
+    case 0xdf:
+        b, err := read_n(r, 4)
+        if err != nil {
+            return nil, err
+        }
+        return msgpack_read_map(r, int(binary.BigEndian.Uint32(b)))
+    }
+
+    return nil, fmt.Errorf("unsupported msgpack type tag 0x%02x", tag)
+}
+
+func read_byte(r io.Reader) (byte, error) {
+    buf, err := read_n(r, 1)
+    if err != nil {
+        return 0, err
+    }
+    return buf[0], nil
+}
+
+func read_n(r io.Reader, n int) ([]byte, error) {
+    buf := make([]byte, n)
+    _, err := io.ReadFull(r, buf)
+    return buf, err
+}
+
+func msgpack_read_string(r io.Reader, n int) (string, error) {
+    buf, err := read_n(r, n)
+    if err != nil {
+        return "", err
+    }
+    return string(buf), nil
+}
+
+func msgpack_read_array(r io.Reader, n int) ([]interface{}, error) {
+    out := make([]interface{}, n)
+    for i := 0; i < n; i++ {
+        v, err := msgpack_decode(r)
+        if err != nil {
+            return nil, err
+        }
+        out[i] = v
+    }
+    return out, nil
+}
+
+func msgpack_read_map(r io.Reader, n int) (map[string]interface{}, error) {
+    out := make(map[string]interface{}, n)
+    for i := 0; i < n; i++ {
+        k, err := msgpack_decode(r)
+        if err != nil {
+            return nil, err
+        }
+        key, ok := k.(string)
+        if !ok {
+            return nil, fmt.Errorf("expected string map key, got %T", k)
+        }
+
+        v, err := msgpack_decode(r)
+        if err != nil {
+            return nil, err
+        }
+        out[key] = v
+    }
+    return out, nil
+}
+
+// PreservesCodec implements Codec using a minimal, hand-rolled encoder
+// and parser for the Preserves text syntax (preserves.dev), covering
+// the subset of the data model this tool actually produces: booleans,
+// strings, arbitrary-precision integers, floats, sequences, and
+// string-keyed dictionaries. Byte strings, sets, symbols, annotations,
+// and embedded values aren't attempted -- a full third-party
+// implementation isn't available since this tree has no
+// go.mod/vendored modules, and none of those appear in aggregated JSON
+// data. Unlike msgpack (which falls back to decimal text once a
+// *big.Int overflows 64 bits), Preserves integers are natively
+// arbitrary precision, so -bignum round-trips through this codec
+// without any such fallback. Each record is written as the two-field
+// record <record "key" {...}>, one per line.
+type PreservesCodec struct {
+    Ctx *Ctx
+}
+
+func (c *PreservesCodec) ReadRecord(r *bufio.Reader) (string, map[string]interface{}, error) {
+    v, err := preserves_decode_value(r)
+    if err != nil {
+        return "", nil, err
+    }
+
+    rec, ok := v.(*preserves_record)
+    if !ok {
+        return "", nil, fmt.Errorf("expected a <record key obj> value, got %T", v)
+    }
+    label, ok := rec.label.(string)
+    if !ok || label != "record" || len(rec.fields) != 2 {
+        return "", nil, fmt.Errorf("expected a <record key obj> value, got %#v", rec)
+    }
+
+    key, ok := rec.fields[0].(string)
+    if !ok {
+        return "", nil, fmt.Errorf("expected a string key, got %T", rec.fields[0])
+    }
+    obj, ok := rec.fields[1].(map[string]interface{})
+    if !ok {
+        return "", nil, fmt.Errorf("expected a dictionary object, got %T", rec.fields[1])
+    }
+
+    if c.Ctx.BigNum {
+        normalize_bignum(obj, c.Ctx.BigFloatPrec)
+    } else {
+        preserves_plain_numbers(obj)
+    }
+
+    return key, obj, nil
+}
+
+func (c *PreservesCodec) WriteRecord(w io.Writer, key string, obj map[string]interface{}) error {
+    if _, err := io.WriteString(w, "<record "); err != nil {
+        return err
+    }
+    if err := preserves_encode_string(w, key); err != nil {
+        return err
+    }
+    if _, err := io.WriteString(w, " "); err != nil {
+        return err
+    }
+    if err := preserves_encode_value(w, obj); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, ">\n")
+    return err
+}
+
+// preserves_record is the parsed/encoded form of a Preserves record
+// (<label field...>). Only used internally by this codec -- the
+// tool's record envelope is always <record "key" {obj}>.
+type preserves_record struct {
+    label interface{}
+    fields []interface{}
+}
+
+// preserves_plain_numbers walks a freshly-parsed Preserves value,
+// converting json.Number leaves (the parser can't know up front
+// whether a Preserves integer literal should become a Go int64 or a
+// float64) into plain float64s, matching decode_record's non-bignum
+// behavior for every other format.
+func preserves_plain_numbers(v interface{}) {
+    if m, ok := v.(map[string]interface{}); ok {
+        for k, e := range m {
+            m[k] = preserves_plain_numbers_value(e)
+        }
+    }
+}
+
+func preserves_plain_numbers_value(v interface{}) interface{} {
+    switch t := v.(type) {
+    case json.Number:
+        f, err := t.Float64()
+        if err != nil {
+            return v
+        }
+        return f
+    case map[string]interface{}:
+        preserves_plain_numbers(t)
+        return t
+    case []interface{}:
+        for i, e := range t {
+            t[i] = preserves_plain_numbers_value(e)
+        }
+        return t
+    }
+    return v
+}
+
+func preserves_encode_value(w io.Writer, v interface{}) error {
+    switch val := v.(type) {
+    case nil:
+        _, err := io.WriteString(w, "<null>")
+        return err
+    case bool:
+        s := "#f"
+        if val {
+            s = "#t"
+        }
+        _, err := io.WriteString(w, s)
+        return err
+    case string:
+        return preserves_encode_string(w, val)
+    case int:
+        _, err := fmt.Fprintf(w, "%d", val)
+        return err
+    case int64:
+        _, err := fmt.Fprintf(w, "%d", val)
+        return err
+    case uint64:
+        _, err := fmt.Fprintf(w, "%d", val)
+        return err
+    case float64:
+        return preserves_encode_float(w, val)
+    case json.Number:
+        _, err := io.WriteString(w, val.String())
+        return err
+    case *big.Int:
+        _, err := io.WriteString(w, val.String())
+        return err
+    case BigFloat:
+        _, err := io.WriteString(w, val.Float.Text('f', val.Prec))
+        return err
+    case map[string]interface{}:
+        return preserves_encode_dict(w, val)
+    case []interface{}:
+        return preserves_encode_seq(w, val)
+    }
+
+    if generic, ok, err := marshaler_to_generic(v); ok {
+        if err != nil {
+            return err
+        }
+        return preserves_encode_value(w, generic)
+    }
+
+    return fmt.Errorf("unsupported type %T for preserves encoding", v)
+}
+
+func preserves_encode_float(w io.Writer, f float64) error {
+    s := strconv.FormatFloat(f, 'f', -1, 64)
+    if !strings.ContainsAny(s, ".eE") {
+        s += ".0"
+    }
+    _, err := io.WriteString(w, s)
+    return err
+}
+
+func preserves_encode_string(w io.Writer, s string) error {
+    var b strings.Builder
+    b.WriteByte('"')
+    for _, r := range s {
+        switch r {
+        case '"':
+            b.WriteString("\\\"")
+        case '\\':
+            b.WriteString("\\\\")
+        case '\n':
+            b.WriteString("\\n")
+        case '\r':
+            b.WriteString("\\r")
+        case '\t':
+            b.WriteString("\\t")
+        default:
+            if r < 0x20 {
+                fmt.Fprintf(&b, "\\u%04x", r)
+            } else {
+                b.WriteRune(r)
+            }
+        }
+    }
+    b.WriteByte('"')
+    _, err := io.WriteString(w, b.String())
+    return err
+}
+
+func preserves_encode_seq(w io.Writer, a []interface{}) error {
+    if _, err := io.WriteString(w, "["); err != nil {
+        return err
+    }
+    for i, v := range a {
+        if i > 0 {
+            if _, err := io.WriteString(w, " "); err != nil {
+                return err
+            }
+        }
+        if err := preserves_encode_value(w, v); err != nil {
+            return err
+        }
+    }
+    _, err := io.WriteString(w, "]")
+    return err
+}
+
+func preserves_encode_dict(w io.Writer, m map[string]interface{}) error {
+    if _, err := io.WriteString(w, "{"); err != nil {
+        return err
+    }
+
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for i, k := range keys {
+        if i > 0 {
+            if _, err := io.WriteString(w, " "); err != nil {
+                return err
+            }
+        }
+        if err := preserves_encode_string(w, k); err != nil {
+            return err
+        }
+        if _, err := io.WriteString(w, ": "); err != nil {
+            return err
+        }
+        if err := preserves_encode_value(w, m[k]); err != nil {
+            return err
+        }
+    }
+
+    _, err := io.WriteString(w, "}")
+    return err
+}
+
+// preserves_skip_ws advances r past any run of whitespace, leaving the
+// next non-whitespace byte unread. Returns the error from the read
+// that found the end of the stream (e.g. io.EOF) if one occurs first.
+func preserves_skip_ws(r *bufio.Reader) error {
+    for {
+        b, err := r.ReadByte()
+        if err != nil {
+            return err
+        }
+        if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+            continue
+        }
+        return r.UnreadByte()
+    }
+}
+
+func preserves_decode_value(r *bufio.Reader) (interface{}, error) {
+    if err := preserves_skip_ws(r); err != nil {
+        return nil, err
+    }
+    b, err := r.ReadByte()
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case b == '#':
+        return preserves_decode_hash(r)
+    case b == '"':
+        s, err := preserves_decode_string(r)
+        if err != nil {
+            return nil, err
+        }
+        return s, nil
+    case b == '<':
+        return preserves_decode_record(r)
+    case b == '[':
+        return preserves_decode_seq(r)
+    case b == '{':
+        return preserves_decode_dict(r)
+    case b == '-' || (b >= '0' && b <= '9'):
+        return preserves_decode_number(r, b)
+    default:
+        return preserves_decode_symbol(r, b)
+    }
+}
+
+func preserves_decode_hash(r *bufio.Reader) (interface{}, error) {
+    b, err := r.ReadByte()
+    if err != nil {
+        return nil, err
+    }
+    switch b {
+    case 't':
+        return true, nil
+    case 'f':
+        return false, nil
+    }
+    return nil, fmt.Errorf("unsupported preserves syntax '#%c' (sets,"+
+        " byte strings, and embedded values aren't implemented)", b)
+}
+
+func preserves_decode_string(r *bufio.Reader) (string, error) {
+    var b strings.Builder
+    for {
+        c, err := r.ReadByte()
+        if err != nil {
+            return "", fmt.Errorf("unterminated string: %s", err)
+        }
+        if c == '"' {
+            return b.String(), nil
+        }
+        if c != '\\' {
+            b.WriteByte(c)
+            continue
+        }
+
+        esc, err := r.ReadByte()
+        if err != nil {
+            return "", fmt.Errorf("unterminated string escape: %s", err)
+        }
+        switch esc {
+        case '"':
+            b.WriteByte('"')
+        case '\\':
+            b.WriteByte('\\')
+        case 'n':
+            b.WriteByte('\n')
+        case 'r':
+            b.WriteByte('\r')
+        case 't':
+            b.WriteByte('\t')
+        case 'u':
+            hex := make([]byte, 4)
+            if _, err := io.ReadFull(r, hex); err != nil {
+                return "", err
+            }
+            n, err := strconv.ParseUint(string(hex), 16, 32)
+            if err != nil {
+                return "", err
+            }
+            b.WriteRune(rune(n))
+        default:
+            b.WriteByte(esc)
+        }
+    }
+}
+
+// preserves_decode_number reads a run of digits (and at most one '.')
+// starting with first, returning a json.Number so the caller can
+// decide -- once -bignum is known -- whether it becomes an arbitrary-
+// precision value or a plain float64, exactly like decode_record does
+// for the tsv-json/ndjson formats.
+func preserves_decode_number(r *bufio.Reader, first byte) (interface{}, error) {
+    var b strings.Builder
+    b.WriteByte(first)
+    is_float := false
+    for {
+        c, err := r.ReadByte()
+        if err != nil {
+            break
+        }
+        if c >= '0' && c <= '9' {
+            b.WriteByte(c)
+            continue
+        }
+        if c == '.' && !is_float {
+            is_float = true
+            b.WriteByte(c)
+            continue
+        }
+        r.UnreadByte()
+        break
+    }
+    return json.Number(b.String()), nil
+}
+
+// preserves_decode_symbol reads a bare identifier (a Preserves symbol)
+// and returns it as a plain Go string -- there's no generic "symbol"
+// concept in the JSON-derived data this tool works with, so a bare
+// identifier is treated the same as a quoted string.
+func preserves_decode_symbol(r *bufio.Reader, first byte) (interface{}, error) {
+    var b strings.Builder
+    b.WriteByte(first)
+    for {
+        c, err := r.ReadByte()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if c == ' ' || c == '\t' || c == '\n' || c == '\r' ||
+            c == '>' || c == ']' || c == '}' || c == ':' {
+            r.UnreadByte()
+            break
+        }
+        b.WriteByte(c)
+    }
+    return b.String(), nil
+}
+
+func preserves_decode_seq(r *bufio.Reader) (interface{}, error) {
+    out := []interface{}{}
+    for {
+        if err := preserves_skip_ws(r); err != nil {
+            return nil, err
+        }
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        if b == ']' {
+            return out, nil
+        }
+        r.UnreadByte()
+
+        v, err := preserves_decode_value(r)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, v)
+    }
+}
+
+func preserves_decode_dict(r *bufio.Reader) (interface{}, error) {
+    out := make(map[string]interface{})
+    for {
+        if err := preserves_skip_ws(r); err != nil {
+            return nil, err
+        }
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        if b == '}' {
+            return out, nil
+        }
+        r.UnreadByte()
+
+        key_val, err := preserves_decode_value(r)
+        if err != nil {
+            return nil, err
+        }
+        key, ok := key_val.(string)
+        if !ok {
+            return nil, fmt.Errorf("expected a string dictionary key, got %T", key_val)
+        }
+
+        if err := preserves_skip_ws(r); err != nil {
+            return nil, err
+        }
+        colon, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        if colon != ':' {
+            return nil, fmt.Errorf("expected ':' after dictionary key %q, got %q", key, colon)
+        }
+
+        v, err := preserves_decode_value(r)
+        if err != nil {
+            return nil, err
+        }
+        out[key] = v
+    }
+}
+
+// preserves_decode_record parses a <label field...> record. The
+// zero-field record <null> is special-cased to Go nil, since the core
+// Preserves data model has no dedicated null/absent value of its own.
+func preserves_decode_record(r *bufio.Reader) (interface{}, error) {
+    label, err := preserves_decode_value(r)
+    if err != nil {
+        return nil, err
+    }
+
+    var fields []interface{}
+    for {
+        if err := preserves_skip_ws(r); err != nil {
+            return nil, err
+        }
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        if b == '>' {
+            break
+        }
+        r.UnreadByte()
+
+        v, err := preserves_decode_value(r)
+        if err != nil {
+            return nil, err
+        }
+        fields = append(fields, v)
+    }
+
+    if label_str, ok := label.(string); ok && label_str == "null" && len(fields) == 0 {
+        return nil, nil
+    }
+
+    return &preserves_record{label: label, fields: fields}, nil
 }
 
 func main() {
@@ -89,313 +1299,1385 @@ func main() {
         writer io.Writer
         sort_output bool
         help bool
+        big_num bool
+        big_float_prec int
+        policy_file_path string
+        default_strategy string
+        tmp_dir string
+        max_runs int
+        parallel int
+        in_format string
+        out_format string
+        key_field string
     )
 
-    flag.Usage = func() {
-        fmt.Fprintf(os.Stderr, "Usage: %s [options] inputfiles ...\n\n", os.Args[0])
-        fmt.Fprintf(os.Stderr, "Options:\n\n")
-        flag.PrintDefaults()
+    flag.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: %s [options] inputfiles ...\n\n", os.Args[0])
+        fmt.Fprintf(os.Stderr, "Options:\n\n")
+        flag.PrintDefaults()
+
+    }
+
+    flag.StringVar(&delimiter, "del", "\t", "Alternate delimiter between key and JSON object")
+    flag.IntVar(&entry_limit, "limit", 0, "If more than `limit` unique keys" +
+        " are found, the in-memory data is spilled, sorted by key, to a" +
+        " temporary run file in -tmpdir, and aggregation continues with" +
+        " an empty map. All run files are merged losslessly at the end," +
+        " so each key still produces exactly one output record. A limit" +
+        " of zero means no limit.")
+    flag.StringVar(&outfile, "outfile", "", "Output file (defaults to standard output)")
+    flag.BoolVar(&sort_output, "sort", false, "Sort output")
+    flag.BoolVar(&help, "help", false, "Display this help message")
+    flag.BoolVar(&big_num, "bignum", false, "Aggregate integers as"+
+        " math/big.Int and floats as math/big.Float instead of"+
+        " int64/uint64/float64, to avoid overflow or precision loss"+
+        " when summing large counters")
+    flag.IntVar(&big_float_prec, "bigprec", 6, "Number of digits after"+
+        " the decimal point to emit for -bignum float sums")
+    flag.StringVar(&policy_file_path, "policy", "", "Path to a JSON file"+
+        " mapping field selectors (e.g. \"$.chips\", \"$.deep.level1.*\")"+
+        " to an aggregation strategy: sum, min, max, avg, first, last,"+
+        " set_union, concat, count_distinct, or histogram. Fields with"+
+        " no matching selector use the -default strategy.")
+    flag.StringVar(&default_strategy, "default", "", "Aggregation"+
+        " strategy to use for fields that match no -policy selector"+
+        " (overrides the policy file's own \"default\"; defaults to"+
+        " \"sum\", the tool's original merge behavior)")
+    flag.StringVar(&tmp_dir, "tmpdir", "", "Directory for run files"+
+        " spilled when -limit is exceeded (defaults to the OS temp dir)")
+    flag.IntVar(&max_runs, "max-runs", 0, "If more than `max-runs` run"+
+        " files have been spilled, merge them down to a single run file"+
+        " before continuing, to bound the number of files open during"+
+        " the final merge. A value of zero means no limit.")
+    flag.IntVar(&parallel, "parallel", 0, "Shard aggregation across"+
+        " `N` worker goroutines, keyed by fnv32(key) % N, instead of"+
+        " the default single-threaded aggregation. Not compatible"+
+        " with -limit. A value of zero or one disables sharding.")
+    flag.StringVar(&in_format, "format", "tsv-json", "Input record"+
+        " format: tsv-json (the original \"key\\t{json}\" layout),"+
+        " ndjson (one JSON object per line, with the key embedded at"+
+        " -key-field), msgpack, or preserves")
+    flag.StringVar(&out_format, "outformat", "", "Output record format,"+
+        " using the same names as -format. Defaults to -format, so"+
+        " input and output only need to be set independently when"+
+        " converting between formats.")
+    flag.StringVar(&key_field, "key-field", "key", "Field selector"+
+        " (e.g. \"$.user.id\") naming where the record's key lives"+
+        " inside the JSON object, for the ndjson format")
+
+    flag.Parse()
+
+    if parallel > 1 && entry_limit > 0 {
+        log.Fatalf("-limit is not supported together with -parallel")
+    }
+
+    if help {
+        flag.Usage()
+        os.Exit(0)
+    }
+
+    if outfile == "" {
+        writer = os.Stdout
+    } else {
+        out_fh, err := os.Create(outfile)
+        if err != nil {
+            log.Fatalf("couldn't open output file %s: %s\n", outfile, err)
+        }
+        defer out_fh.Close()
+
+        writer = out_fh
+    }
+
+    ctx := new(Ctx)
+    ctx.Delimiter = delimiter
+    ctx.Limit = entry_limit
+    ctx.Writer = writer
+    ctx.SortOutput = sort_output
+    ctx.BigNum = big_num
+    ctx.BigFloatPrec = big_float_prec
+    ctx.TmpDir = tmp_dir
+    ctx.MaxRuns = max_runs
+    ctx.Parallel = parallel
+    ctx.KeyField = key_field
+
+    shard_count := parallel
+    if shard_count < 1 {
+        shard_count = 1
+    }
+    ctx.Data = make([]map[string]map[string]interface{}, shard_count)
+    for i := range ctx.Data {
+        ctx.Data[i] = make(map[string]map[string]interface{})
+    }
+
+    in_codec, err := codec_for(in_format, ctx)
+    if err != nil {
+        log.Fatalf("%s", err)
+    }
+    ctx.InCodec = in_codec
+
+    eff_out_format := out_format
+    if eff_out_format == "" {
+        eff_out_format = in_format
+    }
+    out_codec, err := codec_for(eff_out_format, ctx)
+    if err != nil {
+        log.Fatalf("%s", err)
+    }
+    ctx.OutCodec = out_codec
+
+    if policy_file_path != "" {
+        policy, err := load_policy(policy_file_path)
+        if err != nil {
+            log.Fatalf("couldn't load policy file %s: %s", policy_file_path, err)
+        }
+        ctx.Policy = policy
+    }
+    if default_strategy != "" {
+        if ctx.Policy == nil {
+            ctx.Policy = new(Policy)
+        }
+        ctx.Policy.Default = default_strategy
+    }
+
+    files := flag.Args()
+    if len(files) == 0 {
+        process_file(ctx, os.Stdin)
+    } else {
+        for _, file := range files {
+            in_fh, err := os.Open(file)
+            if err != nil {
+                log.Fatalf("couldn't open input file %s: %s", file, err)
+            }
+            process_file(ctx, in_fh)
+            in_fh.Close()
+        }
+    }
+
+    if len(ctx.RunFiles) > 0 {
+        if err := finalize_external_merge(ctx, writer); err != nil {
+            log.Fatalf("couldn't merge spilled run files: %s", err)
+        }
+    } else {
+        write_data(ctx, writer)
+    }
+}
+
+func ProcessFile(reader io.Reader, delimiter string, limit int) map[string]map[string]interface{} {
+    ctx := new(Ctx)
+    ctx.Delimiter = delimiter
+    ctx.Limit = 0
+    ctx.Data = []map[string]map[string]interface{}{make(map[string]map[string]interface{})}
+    ctx.InCodec = &TSVJSONCodec{Ctx: ctx, Delimiter: delimiter}
+
+    process_file(ctx, reader)
+    return ctx.Data[0]
+}
+
+// decode_record parses a record's JSON object, honoring ctx.BigNum to
+// decode numbers via json.Number (and then normalize_bignum) instead
+// of letting encoding/json coerce everything to float64.
+func decode_record(ctx *Ctx, raw string) (map[string]interface{}, error) {
+    data := make(map[string]interface{})
 
+    if ctx.BigNum {
+        dec := json.NewDecoder(strings.NewReader(raw))
+        dec.UseNumber()
+        if err := dec.Decode(&data); err != nil {
+            return nil, err
+        }
+        normalize_bignum(data, ctx.BigFloatPrec)
+        return data, nil
     }
 
-    flag.StringVar(&delimiter, "del", "\t", "Alternate delimiter between key and JSON object")
-    flag.IntVar(&entry_limit, "limit", 0, "If more than `limit` unique keys" +
-        " are found, the data will be flushed to output and aggregation starts" +
-        " over. A limit of zero means no limit.")
-    flag.StringVar(&outfile, "outfile", "", "Output file (defaults to standard output)")
-    flag.BoolVar(&sort_output, "sort", false, "Sort output")
-    flag.BoolVar(&help, "help", false, "Display this help message")
+    if err := json.Unmarshal([]byte(raw), &data); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
 
-    flag.Parse()
+// shard_index picks which of n shards owns key, using an FNV-32 hash
+// so the same key always routes to the same worker/shard.
+func shard_index(key string, n int) int {
+    if n <= 1 {
+        return 0
+    }
 
-    if help {
-        flag.Usage()
-        os.Exit(0)
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return int(h.Sum32() % uint32(n))
+}
+
+func process_file(ctx *Ctx, reader io.Reader) {
+    if len(ctx.Data) > 1 {
+        process_file_parallel(ctx, reader)
+        return
     }
 
-    if outfile == "" {
-        writer = os.Stdout
+    data := ctx.Data[0]
+    br := bufio.NewReader(reader)
+
+    for {
+        key, this_data, err := ctx.InCodec.ReadRecord(br)
+        if err == io.EOF {
+            return
+        }
+        if err != nil {
+            log_read_err(err)
+            continue
+        }
+
+        stored_val, ok := data[key]
+        if !ok {
+            if ctx.Limit > 0 && len(data) >= ctx.Limit {
+                if err := spill_run(ctx); err != nil {
+                    log.Fatalf("couldn't spill aggregation state to disk: %s", err)
+                }
+                ctx.Data[0] = make(map[string]map[string]interface{})
+                data = ctx.Data[0]
+
+                if ctx.MaxRuns > 0 && len(ctx.RunFiles) > ctx.MaxRuns {
+                    if err := compact_runs(ctx); err != nil {
+                        log.Fatalf("couldn't compact spilled run files: %s", err)
+                    }
+                }
+            }
+
+            data[key] = this_data
+            continue
+        }
+
+        if err := aggregate(ctx, stored_val, this_data, nil); err != nil {
+            log.Printf("couldn't aggregate: %s", err)
+        }
+    }
+}
+
+// process_file_parallel shards aggregation across len(ctx.Data)
+// worker goroutines. A single reader goroutine (this one) decodes
+// records via ctx.InCodec and dispatches each (key, obj) pair to the
+// worker that owns its shard over a buffered channel; each worker
+// aggregates against its own private map, so no locking is needed.
+func process_file_parallel(ctx *Ctx, reader io.Reader) {
+    n := len(ctx.Data)
+    type record struct {
+        key string
+        obj map[string]interface{}
+    }
+
+    chans := make([]chan record, n)
+    for i := range chans {
+        chans[i] = make(chan record, 256)
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(n)
+    for i := 0; i < n; i++ {
+        go func(shard int) {
+            defer wg.Done()
+
+            data := ctx.Data[shard]
+            for rec := range chans[shard] {
+                stored_val, ok := data[rec.key]
+                if !ok {
+                    data[rec.key] = rec.obj
+                    continue
+                }
+
+                if err := aggregate(ctx, stored_val, rec.obj, nil); err != nil {
+                    log.Printf("couldn't aggregate: %s", err)
+                }
+            }
+        }(i)
+    }
+
+    br := bufio.NewReader(reader)
+    for {
+        key, obj, err := ctx.InCodec.ReadRecord(br)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            log_read_err(err)
+            continue
+        }
+
+        chans[shard_index(key, n)] <- record{key: key, obj: obj}
+    }
+
+    for _, ch := range chans {
+        close(ch)
+    }
+    wg.Wait()
+}
+
+func aggregate(ctx *Ctx, stored_data map[string]interface{},
+    this_data map[string]interface{}, path []string) error {
+
+    for nk, nv := range this_data {
+        // log.Printf("looking at key %+v, val %+v", nk, nv)
+        ov, ok := stored_data[nk]
+        if !ok {
+            stored_data[nk] = nv
+            continue
+        }
+
+        field_path := append(append([]string{}, path...), nk)
+
+        strategy := "sum"
+        if ctx.Policy != nil {
+            strategy = match_policy(ctx.Policy, field_path)
+        }
+
+        if err := apply_policy(ctx, strategy, field_path, stored_data, nk, ov, nv); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// to_avg_accumulator returns v as-is if it's already an
+// *AvgAccumulator (e.g. restored from a spilled run file), or wraps it
+// as a single-sample accumulator otherwise. Used by apply_policy's
+// "avg" case to merge two run files that both hold an accumulator for
+// the same key, not just a fresh accumulator with a single new value.
+func to_avg_accumulator(v interface{}) *AvgAccumulator {
+    if acc, ok := v.(*AvgAccumulator); ok {
+        return acc
+    }
+    f, _ := numeric_to_float64(v)
+    return &AvgAccumulator{Sum: f, Count: 1}
+}
+
+// to_count_distinct_accumulator is to_avg_accumulator's analog for
+// "count_distinct".
+func to_count_distinct_accumulator(v interface{}) *CountDistinctAccumulator {
+    if acc, ok := v.(*CountDistinctAccumulator); ok {
+        return acc
+    }
+    return &CountDistinctAccumulator{Seen: map[string]struct{}{scalar_label(v): {}}}
+}
+
+// to_histogram_accumulator is to_avg_accumulator's analog for
+// "histogram".
+func to_histogram_accumulator(v interface{}) *HistogramAccumulator {
+    if acc, ok := v.(*HistogramAccumulator); ok {
+        return acc
+    }
+    return &HistogramAccumulator{Counts: map[string]int64{scalar_label(v): 1}}
+}
+
+// apply_policy merges a single field according to the named
+// aggregation strategy. "sum" (the default when no -policy is given)
+// delegates to default_merge, which implements the tool's original
+// merge rule: sum numerics, recurse into maps, append slices, and let
+// the last non-numeric value win.
+func apply_policy(ctx *Ctx, strategy string, path []string,
+    stored_data map[string]interface{}, nk string, ov, nv interface{}) error {
+
+    switch strategy {
+    case "sum", "":
+        return default_merge(ctx, path, stored_data, nk, ov, nv)
+
+    case "min", "max":
+        of, ook := numeric_to_float64(ov)
+        nf, nok := numeric_to_float64(nv)
+        if !ook || !nok {
+            stored_data[nk] = nv
+            return nil
+        }
+        if (strategy == "min" && nf < of) || (strategy == "max" && nf > of) {
+            stored_data[nk] = nv
+        }
+        return nil
+
+    case "avg":
+        acc := to_avg_accumulator(ov)
+        if nacc, ok := nv.(*AvgAccumulator); ok {
+            // Merging two run files that each already hold an
+            // accumulator for this key (e.g. both spilled after
+            // seeing this key more than once): combine their running
+            // state instead of treating nacc as a single new sample.
+            acc.Sum += nacc.Sum
+            acc.Count += nacc.Count
+        } else if f, ok := numeric_to_float64(nv); ok {
+            acc.Sum += f
+            acc.Count++
+        }
+        stored_data[nk] = acc
+        return nil
+
+    case "first":
+        return nil
+
+    case "last":
+        stored_data[nk] = nv
+        return nil
+
+    case "set_union":
+        ov_slice, ook := ov.([]interface{})
+        nv_slice, nok := nv.([]interface{})
+        if !ook || !nok {
+            stored_data[nk] = nv
+            return nil
+        }
+        stored_data[nk] = dedupe_slice(append(ov_slice, nv_slice...))
+        return nil
+
+    case "concat":
+        ov_slice, ook := ov.([]interface{})
+        nv_slice, nok := nv.([]interface{})
+        if ook && nok {
+            stored_data[nk] = append(ov_slice, nv_slice...)
+            return nil
+        }
+        ov_str, osok := ov.(string)
+        nv_str, nsok := nv.(string)
+        if osok && nsok {
+            stored_data[nk] = ov_str + nv_str
+            return nil
+        }
+        stored_data[nk] = nv
+        return nil
+
+    case "count_distinct":
+        acc := to_count_distinct_accumulator(ov)
+        if nacc, ok := nv.(*CountDistinctAccumulator); ok {
+            for s := range nacc.Seen {
+                acc.Seen[s] = struct{}{}
+            }
+        } else {
+            acc.Seen[scalar_label(nv)] = struct{}{}
+        }
+        stored_data[nk] = acc
+        return nil
+
+    case "histogram":
+        acc := to_histogram_accumulator(ov)
+        if nacc, ok := nv.(*HistogramAccumulator); ok {
+            for label, n := range nacc.Counts {
+                acc.Counts[label] += n
+            }
+        } else {
+            acc.Counts[scalar_label(nv)]++
+        }
+        stored_data[nk] = acc
+        return nil
+    }
+
+    log.Printf("unknown aggregation policy %q for %s; using 'last'",
+        strategy, strings.Join(path, "."))
+    stored_data[nk] = nv
+    return nil
+}
+
+func default_merge(ctx *Ctx, path []string, stored_data map[string]interface{},
+    nk string, ov, nv interface{}) error {
+
+    ov_v := reflect.ValueOf(ov)
+    ov_is_num, ov_is_int, ov_is_signed := is_num_type(ov_v)
+
+    nv_v := reflect.ValueOf(nv)
+    nv_is_num, nv_is_int, nv_is_signed := is_num_type(nv_v)
+
+    if ov_is_num && !nv_is_num {
+        // Drop since the old value was a numeric type and this one isn't
+        return nil
+    }
+
+    if !ov_is_num {
+        // Last non-numeric value wins
+
+        nv_kind := nv_v.Kind()
+        ov_kind := ov_v.Kind()
+
+        if nv_kind != ov_kind {
+            stored_data[nk] = nv
+            return nil
+        }
+
+        if nv_kind == reflect.Map {
+            ov_map, ok := ov.(map[string]interface{})
+            if !ok {
+                return fmt.Errorf("assertion of ov to map[string]interface{} failed")
+            }
+            nv_map, ok := nv.(map[string]interface{})
+            if !ok {
+                return fmt.Errorf("assertion of nv to map[string]interface{} failed")
+            }
+
+            return aggregate(ctx, ov_map, nv_map, path)
+        }
+
+        if nv_kind == reflect.Slice {
+            ov_slice, ok := ov.([]interface{})
+            if !ok {
+                return fmt.Errorf("assertion of ov to []interface{} failed")
+            }
+            nv_slice, ok := nv.([]interface{})
+            if !ok {
+                return fmt.Errorf("assertion of nv to []interface{} failed")
+            }
+
+            stored_data[nk] = append(ov_slice, nv_slice...)
+            return nil
+        }
+
+        stored_data[nk] = nv
+        return nil
+    }
+
+    if ctx.BigNum {
+        sum, err := add_bignum(ov, nv, ctx.BigFloatPrec)
+        if err != nil {
+            return err
+        }
+        stored_data[nk] = sum
+        return nil
+    }
+
+    if ov_is_int && nv_is_int {
+        if nv_is_signed == ov_is_signed {
+            if nv_is_signed {
+                sum := ov_v.Int() + nv_v.Int()
+                stored_data[nk] = sum
+            } else {
+                sum := ov_v.Uint() + nv_v.Uint()
+                stored_data[nk] = sum
+            }
+        } else {
+            if nv_is_signed {
+                sum := int64(ov_v.Uint()) + nv_v.Int()
+                stored_data[nk] = sum
+            } else {
+                sum := ov_v.Int() + int64(nv_v.Uint())
+                stored_data[nk] = sum
+            }
+        }
+        return nil
+    }
+
+    // FIXME: handle at least one of them being a float
+    ov_float := float64(0)
+    nv_float := float64(0)
+
+    if ov_is_int {
+        if ov_is_signed {
+            ov_float = float64(ov_v.Int())
+        } else {
+            ov_float = float64(ov_v.Uint())
+        }
     } else {
-        out_fh, err := os.Create(outfile)
+        ov_float = ov_v.Float()
+    }
+
+    if nv_is_int {
+        if nv_is_signed {
+            nv_float = float64(nv_v.Int())
+        } else {
+            nv_float = float64(nv_v.Uint())
+        }
+    } else {
+        nv_float = nv_v.Float()
+    }
+
+    stored_data[nk] = ov_float + nv_float
+    return nil
+}
+
+func is_num_type(v reflect.Value) (bool, bool, bool) {
+    switch v.Kind() {
+    case reflect.Int64:
+        fallthrough
+    case reflect.Int32:
+        fallthrough
+    case reflect.Int16:
+        fallthrough
+    case reflect.Int8:
+        fallthrough
+    case reflect.Int:
+        return true, true, true
+    case reflect.Uint64:
+        fallthrough
+    case reflect.Uint32:
+        fallthrough
+    case reflect.Uint16:
+        fallthrough
+    case reflect.Uint8:
+        fallthrough
+    case reflect.Uint:
+        return true, true, false
+    case reflect.Float64:
+        fallthrough
+    case reflect.Float32:
+        return true, false, true
+    }
+
+    if v.IsValid() {
+        switch v.Interface().(type) {
+        case json.Number, *big.Int, BigFloat:
+            // Arbitrary-precision values are numeric, but don't map
+            // to a fixed-width int/float kind, so is_int/is_signed
+            // are meaningless here; add_bignum does the real dispatch.
+            return true, false, false
+        }
+    }
+
+    return false, false, false
+}
+
+// to_bignum converts a decoded JSON numeric value into a *big.Int or
+// BigFloat, preferring *big.Int whenever the value parses as an
+// integer so that integer sums stay exact.
+func to_bignum(v interface{}, prec int) (interface{}, error) {
+    switch n := v.(type) {
+    case *big.Int:
+        return n, nil
+    case BigFloat:
+        return n, nil
+    case json.Number:
+        s := n.String()
+        if !strings.ContainsAny(s, ".eE") {
+            if i, ok := new(big.Int).SetString(s, 10); ok {
+                return i, nil
+            }
+        }
+        f, _, err := big.ParseFloat(s, 10, 0, big.ToNearestEven)
         if err != nil {
-            log.Fatalf("couldn't open output file %s: %s\n", outfile, err)
+            return nil, fmt.Errorf("couldn't parse '%s' as a number: %s", s, err)
         }
-        defer out_fh.Close()
+        return BigFloat{f, prec}, nil
+    case int64:
+        return big.NewInt(n), nil
+    case uint64:
+        return new(big.Int).SetUint64(n), nil
+    case float64:
+        return BigFloat{big.NewFloat(n), prec}, nil
+    }
+
+    return nil, fmt.Errorf("unsupported type %T for -bignum aggregation", v)
+}
+
+// add_bignum sums two numeric values using arbitrary precision,
+// promoting the result to BigFloat if either operand is non-integral.
+func add_bignum(ov, nv interface{}, prec int) (interface{}, error) {
+    ov_big, err := to_bignum(ov, prec)
+    if err != nil {
+        return nil, err
+    }
+    nv_big, err := to_bignum(nv, prec)
+    if err != nil {
+        return nil, err
+    }
+
+    ov_int, ov_is_int := ov_big.(*big.Int)
+    nv_int, nv_is_int := nv_big.(*big.Int)
+
+    if ov_is_int && nv_is_int {
+        return new(big.Int).Add(ov_int, nv_int), nil
+    }
+
+    return BigFloat{new(big.Float).Add(to_big_float(ov_big), to_big_float(nv_big)), prec}, nil
+}
+
+func to_big_float(v interface{}) *big.Float {
+    switch n := v.(type) {
+    case *big.Int:
+        return new(big.Float).SetInt(n)
+    case BigFloat:
+        return n.Float
+    }
+
+    return new(big.Float)
+}
+
+// normalize_bignum walks a freshly-decoded (UseNumber) record,
+// replacing json.Number leaves with *big.Int/BigFloat so later
+// aggregation rounds operate on arbitrary-precision values directly
+// instead of re-parsing the original string each time.
+func normalize_bignum(m map[string]interface{}, prec int) {
+    for k, v := range m {
+        m[k] = normalize_bignum_value(v, prec)
+    }
+}
+
+func normalize_bignum_value(v interface{}, prec int) interface{} {
+    switch t := v.(type) {
+    case json.Number:
+        n, err := to_bignum(t, prec)
+        if err != nil {
+            return v
+        }
+        return n
+    case map[string]interface{}:
+        normalize_bignum(t, prec)
+        return t
+    case []interface{}:
+        for i, e := range t {
+            t[i] = normalize_bignum_value(e, prec)
+        }
+        return t
+    }
+
+    return v
+}
+
+// Policy holds a compiled -policy configuration: a default aggregation
+// strategy plus a set of field-selector rules, most-specific match
+// wins when more than one rule matches a given path.
+type Policy struct {
+    Default string
+    Rules []PolicyRule
+}
+
+// PolicyRule maps a compiled field path (e.g. ["deep", "level1", "*"])
+// to a named aggregation strategy.
+type PolicyRule struct {
+    Path []string
+    Strategy string
+}
+
+// policyFile is the on-disk JSON shape read by load_policy, e.g.:
+//
+//     {
+//         "default": "last",
+//         "rules": {
+//             "$.chips": "max",
+//             "$.deep.level1.*": "min",
+//             "$.versions[]": "set_union"
+//         }
+//     }
+type policyFile struct {
+    Default string `json:"default"`
+    Rules map[string]string `json:"rules"`
+}
 
-        writer = out_fh
+// load_policy reads a JSON policy file and compiles its field
+// selectors into a Policy.
+func load_policy(path string) (*Policy, error) {
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
     }
 
-    ctx := new(Ctx)
-    ctx.Delimiter = delimiter
-    ctx.Limit = entry_limit
-    ctx.Data = make(map[string]map[string]interface{})
-    ctx.Writer = writer
-    ctx.SortOutput = sort_output
+    var pf policyFile
+    if err := json.Unmarshal(raw, &pf); err != nil {
+        return nil, fmt.Errorf("couldn't parse policy file %s: %s", path, err)
+    }
 
-    files := flag.Args()
-    if len(files) == 0 {
-        process_file(ctx, os.Stdin)
-    } else {
-        for _, file := range files {
-            in_fh, err := os.Open(file)
-            if err != nil {
-                log.Fatalf("couldn't open input file %s: %s", file, err)
-            }
-            process_file(ctx, in_fh)
-            in_fh.Close()
-        }
+    policy := &Policy{Default: pf.Default}
+    for selector, strategy := range pf.Rules {
+        policy.Rules = append(policy.Rules, PolicyRule{
+            Path: compile_policy_path(selector),
+            Strategy: strategy,
+        })
     }
 
-    write_data(ctx, writer)
+    return policy, nil
 }
 
-func ProcessFile(reader io.Reader, delimiter string, limit int) map[string]map[string]interface{} {
-    ctx := new(Ctx)
-    ctx.Delimiter = delimiter
-    ctx.Limit = 0
-    ctx.Data = make(map[string]map[string]interface{})
+// compile_policy_path turns a JSONPath-like selector such as
+// "$.deep.level1.*" or "$.versions[]" into the segment list used to
+// match against the path built up during aggregation.
+func compile_policy_path(selector string) []string {
+    s := strings.TrimPrefix(selector, "$.")
+    s = strings.TrimPrefix(s, "$")
+    s = strings.TrimSuffix(s, "[]")
+    if s == "" {
+        return nil
+    }
+    return strings.Split(s, ".")
+}
 
-    process_file(ctx, reader)
-    return ctx.Data
+// match_policy returns the strategy for the most specific rule whose
+// path matches, falling back to the policy's default ("sum" if unset).
+func match_policy(p *Policy, path []string) string {
+    strategy := p.Default
+    if strategy == "" {
+        strategy = "sum"
+    }
+
+    best := -1
+    for _, rule := range p.Rules {
+        if len(rule.Path) <= best || !path_matches(rule.Path, path) {
+            continue
+        }
+        best = len(rule.Path)
+        strategy = rule.Strategy
+    }
+
+    return strategy
 }
 
-func process_file(ctx *Ctx, reader io.Reader) {
-    data := ctx.Data
-    scanner := bufio.NewScanner(reader)
-    line_cnt := 0
-
-    for scanner.Scan() {
-        line := scanner.Text()
-        line_cnt++
-        parts := strings.SplitN(line, ctx.Delimiter, 2)
-        if len(parts) < 2 {
-            log.Fatalf("wrong number of fields at line %d: %d: '%s'", line_cnt,
-                len(parts), line)
+// path_matches reports whether pattern matches path, where a "*"
+// segment in pattern matches any single path segment.
+func path_matches(pattern, path []string) bool {
+    if len(pattern) != len(path) {
+        return false
+    }
+    for i, seg := range pattern {
+        if seg != "*" && seg != path[i] {
+            return false
         }
-        this_data := make(map[string]interface{})
-        err := json.Unmarshal([]byte(parts[1]), &this_data)
+    }
+    return true
+}
+
+// numeric_to_float64 extracts a float64 view of any value aggregate
+// treats as numeric, including the arbitrary-precision types used by
+// -bignum, for use by policy strategies that compare or average values.
+func numeric_to_float64(v interface{}) (float64, bool) {
+    switch n := v.(type) {
+    case *big.Int:
+        f := new(big.Float).SetInt(n)
+        r, _ := f.Float64()
+        return r, true
+    case BigFloat:
+        r, _ := n.Float.Float64()
+        return r, true
+    case json.Number:
+        f, err := n.Float64()
         if err != nil {
-            log.Printf("couldn't parse JSON object '%s': %s", parts[1], err)
-            continue
+            return 0, false
         }
+        return f, true
+    }
 
-        stored_val, ok := data[parts[0]]
-        if !ok {
-            if ctx.Limit > 0 && len(data) >= ctx.Limit {
-                write_data(ctx, ctx.Writer)
-                ctx.Data = make(map[string]map[string]interface{})
-                data = ctx.Data
-            }
+    rv := reflect.ValueOf(v)
+    is_num, is_int, is_signed := is_num_type(rv)
+    if !is_num {
+        return 0, false
+    }
+    if is_int {
+        if is_signed {
+            return float64(rv.Int()), true
+        }
+        return float64(rv.Uint()), true
+    }
+    return rv.Float(), true
+}
 
-            data[parts[0]] = this_data
+// dedupe_slice drops duplicate elements (compared by their JSON
+// representation) from s, keeping the first occurrence of each.
+func dedupe_slice(s []interface{}) []interface{} {
+    seen := make(map[string]bool, len(s))
+    out := make([]interface{}, 0, len(s))
+    for _, v := range s {
+        key := value_key(v)
+        if seen[key] {
             continue
         }
+        seen[key] = true
+        out = append(out, v)
+    }
+    return out
+}
 
-        err = aggregate(ctx, stored_val, this_data)
-        if err != nil {
-            log.Printf("couldn't aggregate: %s", err)
-        }
+// value_key returns a comparable string representation of v, used to
+// dedupe slice elements in the set_union strategy.
+func value_key(v interface{}) string {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return fmt.Sprintf("%v", v)
     }
+    return string(b)
 }
 
-func aggregate(ctx *Ctx, stored_data map[string]interface{},
-    this_data map[string]interface{}) error {
+// scalar_label returns a human-readable string label for v, used as
+// the map key in the count_distinct/histogram accumulators. Strings
+// are used as-is so they don't end up double-quoted in the output.
+func scalar_label(v interface{}) string {
+    if s, ok := v.(string); ok {
+        return s
+    }
+    return value_key(v)
+}
 
-    for nk, nv := range this_data {
-        // log.Printf("looking at key %+v, val %+v", nk, nv)
-        ov, ok := stored_data[nk]
-        if !ok {
-            stored_data[nk] = nv
-            continue
+// AvgAccumulator tracks a running sum and count for the "avg" policy
+// strategy, serializing to just the mean.
+type AvgAccumulator struct {
+    Sum float64
+    Count int64
+}
+
+func (a *AvgAccumulator) MarshalJSON() ([]byte, error) {
+    if a.Count == 0 {
+        return []byte("0"), nil
+    }
+    return json.Marshal(a.Sum / float64(a.Count))
+}
+
+// CountDistinctAccumulator tracks the distinct values seen for the
+// "count_distinct" policy strategy, serializing to just the count.
+type CountDistinctAccumulator struct {
+    Seen map[string]struct{}
+}
+
+func (c *CountDistinctAccumulator) MarshalJSON() ([]byte, error) {
+    return json.Marshal(len(c.Seen))
+}
+
+// HistogramAccumulator tracks per-value counts for the "histogram"
+// policy strategy, serializing to a value -> count map.
+type HistogramAccumulator struct {
+    Counts map[string]int64
+}
+
+func (h *HistogramAccumulator) MarshalJSON() ([]byte, error) {
+    return json.Marshal(h.Counts)
+}
+
+// spill_tag_key marks an accumulator's on-wire shape in a run file,
+// e.g. {"__acc":"avg","sum":1,"count":2}. Run files must round-trip
+// accumulators through their full state, not through MarshalJSON's
+// collapsed user-facing view (just the mean, just the count, ...),
+// or a spill mid-aggregation would silently discard the running
+// sum/count/seen-set and reseed it as if from a single fresh sample.
+const spill_tag_key = "__acc"
+
+// prepare_for_spill deep-copies v, replacing any accumulator value
+// with a tagged map that json.Marshal serializes losslessly, and
+// recursing into nested maps/slices the same way aggregate does.
+func prepare_for_spill(v interface{}) interface{} {
+    switch t := v.(type) {
+    case *AvgAccumulator:
+        return map[string]interface{}{
+            spill_tag_key: "avg",
+            "sum": t.Sum,
+            "count": t.Count,
         }
 
-        ov_v := reflect.ValueOf(ov)
-        ov_is_num, ov_is_int, ov_is_signed := is_num_type(ov_v)
+    case *CountDistinctAccumulator:
+        seen := make([]string, 0, len(t.Seen))
+        for s := range t.Seen {
+            seen = append(seen, s)
+        }
+        return map[string]interface{}{
+            spill_tag_key: "count_distinct",
+            "seen": seen,
+        }
 
-        nv_v := reflect.ValueOf(nv)
-        nv_is_num, nv_is_int, nv_is_signed := is_num_type(nv_v)
+    case *HistogramAccumulator:
+        return map[string]interface{}{
+            spill_tag_key: "histogram",
+            "counts": t.Counts,
+        }
 
-        if ov_is_num && !nv_is_num {
-            // Drop since the old value was a numeric type and this one isn't
-            continue
+    case map[string]interface{}:
+        out := make(map[string]interface{}, len(t))
+        for k, v := range t {
+            out[k] = prepare_for_spill(v)
         }
+        return out
 
-        if !ov_is_num {
-            // Last non-numeric value wins
+    case []interface{}:
+        out := make([]interface{}, len(t))
+        for i, e := range t {
+            out[i] = prepare_for_spill(e)
+        }
+        return out
+    }
 
-            nv_kind := nv_v.Kind()
-            ov_kind := ov_v.Kind()
+    return v
+}
 
-            if nv_kind != ov_kind {
-                stored_data[nk] = nv
-                continue
-            }
+// restore_from_spill is prepare_for_spill's inverse, applied after
+// decoding a record read back from a run file, so accumulators
+// continue accumulating from their real state.
+func restore_from_spill(v interface{}) interface{} {
+    switch t := v.(type) {
+    case map[string]interface{}:
+        if tag, ok := t[spill_tag_key].(string); ok {
+            switch tag {
+            case "avg":
+                sum, _ := numeric_to_float64(t["sum"])
+                count, _ := numeric_to_float64(t["count"])
+                return &AvgAccumulator{Sum: sum, Count: int64(count)}
 
-            if nv_kind == reflect.Map {
-                ov_map, ok := ov.(map[string]interface{})
-                if !ok {
-                    return fmt.Errorf("assertion of ov to map[string]interface{} failed")
-                }
-                nv_map, ok := nv.(map[string]interface{})
-                if !ok {
-                    return fmt.Errorf("assertion of nv to map[string]interface{} failed")
+            case "count_distinct":
+                seen := make(map[string]struct{})
+                if list, ok := t["seen"].([]interface{}); ok {
+                    for _, s := range list {
+                        if str, ok := s.(string); ok {
+                            seen[str] = struct{}{}
+                        }
+                    }
                 }
+                return &CountDistinctAccumulator{Seen: seen}
 
-                err := aggregate(ctx, ov_map, nv_map)
-                if err != nil {
-                    return err
+            case "histogram":
+                counts := make(map[string]int64)
+                if cm, ok := t["counts"].(map[string]interface{}); ok {
+                    for label, n := range cm {
+                        if f, ok := numeric_to_float64(n); ok {
+                            counts[label] = int64(f)
+                        }
+                    }
                 }
-                continue
+                return &HistogramAccumulator{Counts: counts}
             }
+        }
 
-            if nv_kind == reflect.Slice {
-                ov_slice, ok := ov.([]interface{})
-                if !ok {
-                    return fmt.Errorf("assertion of ov to []interface{} failed")
-                }
-                nv_slice, ok := nv.([]interface{})
-                if !ok {
-                    return fmt.Errorf("assertion of nv to []interface{} failed")
-                }
+        out := make(map[string]interface{}, len(t))
+        for k, v := range t {
+            out[k] = restore_from_spill(v)
+        }
+        return out
 
-                stored_data[nk] = append(ov_slice, nv_slice...)
-                continue
+    case []interface{}:
+        out := make([]interface{}, len(t))
+        for i, e := range t {
+            out[i] = restore_from_spill(e)
+        }
+        return out
+    }
+
+    return v
+}
+
+func write_data(ctx *Ctx, writer io.Writer) {
+    if ctx.SortOutput {
+        write_data_sorted(ctx, writer)
+        return
+    }
+
+    for _, shard := range ctx.Data {
+        for k, v := range shard {
+            if err := ctx.OutCodec.WriteRecord(writer, k, v); err != nil {
+                log.Printf("couldn't write record for key %s: %s", k, err)
             }
+        }
+    }
+}
 
-            stored_data[nk] = nv
+// write_data_sorted sorts each shard's records independently, then
+// does an in-memory k-way merge across shards so the combined output
+// comes out sorted by key without having to sort everything at once.
+// A given key is only ever present in one shard, so no two shards can
+// produce the same key and no aggregation step is needed here.
+func write_data_sorted(ctx *Ctx, writer io.Writer) {
+    h := &shard_heap{}
+    for _, shard := range ctx.Data {
+        if len(shard) == 0 {
             continue
         }
 
-        if ov_is_int && nv_is_int {
-            if nv_is_signed == ov_is_signed {
-                if nv_is_signed {
-                    sum := ov_v.Int() + nv_v.Int()
-                    stored_data[nk] = sum
-                } else {
-                    sum := ov_v.Uint() + nv_v.Uint()
-                    stored_data[nk] = sum
-                }
-            } else {
-                if nv_is_signed {
-                    sum := int64(ov_v.Uint()) + nv_v.Int()
-                    stored_data[nk] = sum
-                } else {
-                    sum := ov_v.Int() + int64(nv_v.Uint())
-                    stored_data[nk] = sum
-                }
-            }
-            continue
+        rows := make(keyed_rows, 0, len(shard))
+        for k, v := range shard {
+            rows = append(rows, keyed_row{key: k, obj: v})
         }
 
-        // FIXME: handle at least one of them being a float
-        ov_float := float64(0)
-        nv_float := float64(0)
+        sort.Sort(rows)
+        *h = append(*h, &shard_cursor{rows: rows})
+    }
+    heap.Init(h)
 
-        if ov_is_int {
-            if ov_is_signed {
-                ov_float = float64(ov_v.Int())
-            } else {
-                ov_float = float64(ov_v.Uint())
-            }
-        } else {
-            ov_float = ov_v.Float()
+    for h.Len() > 0 {
+        cur := (*h)[0]
+        row := cur.rows[cur.idx]
+        if err := ctx.OutCodec.WriteRecord(writer, row.key, row.obj); err != nil {
+            log.Printf("couldn't write record for key %s: %s", row.key, err)
         }
 
-        if nv_is_int {
-            if nv_is_signed {
-                nv_float = float64(nv_v.Int())
-            } else {
-                nv_float = float64(nv_v.Uint())
-            }
+        cur.idx++
+        if cur.idx >= len(cur.rows) {
+            heap.Pop(h)
         } else {
-            nv_float = nv_v.Float()
+            heap.Fix(h, 0)
+        }
+    }
+}
+
+// keyed_row pairs a record's key and decoded object, for sorting in
+// memory without going through a codec's wire format first.
+type keyed_row struct {
+    key string
+    obj map[string]interface{}
+}
+
+type keyed_rows []keyed_row
+
+func (r keyed_rows) Len() int { return len(r) }
+func (r keyed_rows) Less(i, j int) bool { return r[i].key < r[j].key }
+func (r keyed_rows) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+// shard_cursor walks one shard's pre-sorted rows for the merge in
+// write_data_sorted.
+type shard_cursor struct {
+    rows keyed_rows
+    idx int
+}
+
+type shard_heap []*shard_cursor
+
+func (h shard_heap) Len() int { return len(h) }
+func (h shard_heap) Less(i, j int) bool { return h[i].rows[h[i].idx].key < h[j].rows[h[j].idx].key }
+func (h shard_heap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *shard_heap) Push(x interface{}) {
+    *h = append(*h, x.(*shard_cursor))
+}
+
+func (h *shard_heap) Pop() interface{} {
+    old := *h
+    n := len(old)
+    cur := old[n-1]
+    *h = old[:n-1]
+    return cur
+}
+
+type DataSorter struct {
+    Data [][]string
+}
+
+func (d *DataSorter) Len() int {
+    return len(d.Data)
+}
+
+func (d *DataSorter) Less(i, j int) bool {
+    return d.Data[i][0] < d.Data[j][0]
+}
+
+func (d *DataSorter) Swap(i, j int) {
+    d.Data[i], d.Data[j] = d.Data[j], d.Data[i]
+}
+
+// spill_run serializes ctx.Data, sorted by key, to a new gzip-compressed
+// run file under ctx.TmpDir and records its path in ctx.RunFiles. It is
+// called when -limit is exceeded, so that aggregation can continue with
+// an empty in-memory map instead of flushing partial records to output.
+func spill_run(ctx *Ctx) error {
+    data := ctx.Data[0]
+    rows := make([][]string, 0, len(data))
+    for k, v := range data {
+        serialized, err := json.Marshal(prepare_for_spill(v))
+        if err != nil {
+            log.Printf("couldn't convert data to JSON")
+            continue
         }
+        rows = append(rows, []string{k, string(serialized)})
+    }
+
+    sorter := &DataSorter{Data: rows}
+    sort.Sort(sorter)
+
+    fh, err := os.CreateTemp(ctx.TmpDir, "dstatsaggjson-run-*.tsv.gz")
+    if err != nil {
+        return fmt.Errorf("couldn't create run file: %s", err)
+    }
+    defer fh.Close()
+
+    gz := gzip.NewWriter(fh)
+    defer gz.Close()
 
-        stored_data[nk] = ov_float + nv_float
+    for _, row := range rows {
+        fmt.Fprintf(gz, "%s\t%s\n", row[0], row[1])
     }
 
+    ctx.RunFiles = append(ctx.RunFiles, fh.Name())
     return nil
 }
 
-func is_num_type(v reflect.Value) (bool, bool, bool) {
-    switch v.Kind() {
-    case reflect.Int64:
-        fallthrough
-    case reflect.Int32:
-        fallthrough
-    case reflect.Int16:
-        fallthrough
-    case reflect.Int8:
-        fallthrough
-    case reflect.Int:
-        return true, true, true
-    case reflect.Uint64:
-        fallthrough
-    case reflect.Uint32:
-        fallthrough
-    case reflect.Uint16:
-        fallthrough
-    case reflect.Uint8:
-        fallthrough
-    case reflect.Uint:
-        return true, true, false
-    case reflect.Float64:
-        fallthrough
-    case reflect.Float32:
-        return true, false, true
+// run_iterator reads one gzip-compressed run file as a sequence of
+// (key, data) records sorted by key, for use as a source in the
+// k-way merge performed by merge_runs.
+type run_iterator struct {
+    ctx *Ctx
+    fh *os.File
+    gz *gzip.Reader
+    scanner *bufio.Scanner
+    key string
+    data map[string]interface{}
+    done bool
+}
+
+func open_run(ctx *Ctx, path string) (*run_iterator, error) {
+    fh, err := os.Open(path)
+    if err != nil {
+        return nil, err
     }
 
-    return false, false, false
+    gz, err := gzip.NewReader(fh)
+    if err != nil {
+        fh.Close()
+        return nil, err
+    }
+
+    it := &run_iterator{ctx: ctx, fh: fh, gz: gz, scanner: bufio.NewScanner(gz)}
+    it.advance()
+    return it, nil
 }
 
-func write_data(ctx *Ctx, writer io.Writer) {
-    out_delimiter := "\t"
+// advance reads the next record from the run file into it.key/it.data,
+// marking it.done once the file is exhausted.
+func (it *run_iterator) advance() {
+    for it.scanner.Scan() {
+        line := it.scanner.Text()
+        parts := strings.SplitN(line, "\t", 2)
+        if len(parts) < 2 {
+            log.Printf("malformed run-file record: %q", line)
+            continue
+        }
 
-    if ctx.SortOutput {
-        data := make([][]string, 0, len(ctx.Data))
-        for k,v := range ctx.Data {
-            serialized, err := json.Marshal(v)
-            if err != nil {
-                log.Printf("couldn't convert data to JSON")
+        data := make(map[string]interface{})
+        if it.ctx.BigNum {
+            dec := json.NewDecoder(strings.NewReader(parts[1]))
+            dec.UseNumber()
+            if err := dec.Decode(&data); err != nil {
+                log.Printf("couldn't parse run-file JSON %q: %s", parts[1], err)
+                continue
+            }
+            normalize_bignum(data, it.ctx.BigFloatPrec)
+        } else {
+            if err := json.Unmarshal([]byte(parts[1]), &data); err != nil {
+                log.Printf("couldn't parse run-file JSON %q: %s", parts[1], err)
                 continue
             }
-            data = append(data, []string{k, string(serialized)})
         }
 
-        sorter := new(DataSorter)
-        sorter.Data = data
+        it.key = parts[0]
+        it.data = restore_from_spill(data).(map[string]interface{})
+        return
+    }
+
+    it.done = true
+    it.gz.Close()
+    it.fh.Close()
+}
+
+// run_heap is a container/heap min-heap of run_iterators ordered by
+// their current key, used to drive the k-way merge in merge_runs.
+type run_heap []*run_iterator
+
+func (h run_heap) Len() int { return len(h) }
+func (h run_heap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h run_heap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *run_heap) Push(x interface{}) {
+    *h = append(*h, x.(*run_iterator))
+}
+
+func (h *run_heap) Pop() interface{} {
+    old := *h
+    n := len(old)
+    it := old[n-1]
+    *h = old[:n-1]
+    return it
+}
+
+// merge_runs performs a k-way merge of the given sorted run files,
+// aggregating every record sharing a key into a single record before
+// calling emit exactly once per key, in ascending key order.
+func merge_runs(ctx *Ctx, paths []string, emit func(key string, data map[string]interface{}) error) error {
+    h := &run_heap{}
+    heap.Init(h)
+
+    for _, path := range paths {
+        it, err := open_run(ctx, path)
+        if err != nil {
+            return fmt.Errorf("couldn't open run file %s: %s", path, err)
+        }
+        if !it.done {
+            heap.Push(h, it)
+        }
+    }
+
+    for h.Len() > 0 {
+        top := heap.Pop(h).(*run_iterator)
+        key := top.key
+        merged := top.data
+
+        top.advance()
+        if !top.done {
+            heap.Push(h, top)
+        }
 
-        sort.Sort(sorter)
+        for h.Len() > 0 && (*h)[0].key == key {
+            next := heap.Pop(h).(*run_iterator)
+            if err := aggregate(ctx, merged, next.data, nil); err != nil {
+                return err
+            }
 
-        for _, d := range data {
-            fmt.Fprintf(writer, "%s%s%s\n", d[0], out_delimiter, d[1])
+            next.advance()
+            if !next.done {
+                heap.Push(h, next)
+            }
         }
 
-        return
+        if err := emit(key, merged); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// compact_runs merges the currently spilled run files down to a
+// single new run file, bounding the number of run files that will be
+// open simultaneously during the final merge. It is triggered once
+// -max-runs is exceeded.
+func compact_runs(ctx *Ctx) error {
+    fh, err := os.CreateTemp(ctx.TmpDir, "dstatsaggjson-run-*.tsv.gz")
+    if err != nil {
+        return fmt.Errorf("couldn't create run file: %s", err)
     }
 
-    for k,v := range ctx.Data {
-        serialized, err := json.Marshal(v)
+    gz := gzip.NewWriter(fh)
+
+    old_paths := ctx.RunFiles
+    err = merge_runs(ctx, old_paths, func(key string, data map[string]interface{}) error {
+        serialized, err := json.Marshal(prepare_for_spill(data))
         if err != nil {
-            log.Printf("couldn't convert data to JSON")
-            continue
+            return err
+        }
+        _, err = fmt.Fprintf(gz, "%s\t%s\n", key, serialized)
+        return err
+    })
+
+    gz_err := gz.Close()
+    fh_err := fh.Close()
+
+    if err != nil || gz_err != nil || fh_err != nil {
+        os.Remove(fh.Name())
+        if err != nil {
+            return err
+        }
+        if gz_err != nil {
+            return gz_err
         }
-        fmt.Fprintf(writer, "%s%s%s\n", k, out_delimiter, serialized)
+        return fh_err
     }
-}
 
-type DataSorter struct {
-    Data [][]string
-}
+    for _, path := range old_paths {
+        os.Remove(path)
+    }
 
-func (d *DataSorter) Len() int {
-    return len(d.Data)
+    ctx.RunFiles = []string{fh.Name()}
+    return nil
 }
 
-func (d *DataSorter) Less(i, j int) bool {
-    return d.Data[i][0] < d.Data[j][0]
-}
+// finalize_external_merge spills any remaining in-memory data as a
+// last run file, then performs the final k-way merge of every spilled
+// run file straight to writer, removing the run files once done.
+func finalize_external_merge(ctx *Ctx, writer io.Writer) error {
+    if len(ctx.Data[0]) > 0 {
+        if err := spill_run(ctx); err != nil {
+            return err
+        }
+        ctx.Data[0] = make(map[string]map[string]interface{})
+    }
 
-func (d *DataSorter) Swap(i, j int) {
-    d.Data[i], d.Data[j] = d.Data[j], d.Data[i]
+    paths := ctx.RunFiles
+    defer func() {
+        for _, path := range paths {
+            os.Remove(path)
+        }
+    }()
+
+    return merge_runs(ctx, paths, func(key string, data map[string]interface{}) error {
+        if err := ctx.OutCodec.WriteRecord(writer, key, data); err != nil {
+            log.Printf("couldn't write record for key %s: %s", key, err)
+        }
+        return nil
+    })
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// bench_input builds n tab-delimited records across num_keys distinct
+// keys, so the hot path (JSON parse + reflect-driven merge) sees
+// realistic key collisions to aggregate.
+func bench_input(n, num_keys int) []byte {
+    var buf bytes.Buffer
+    for i := 0; i < n; i++ {
+        fmt.Fprintf(&buf, "key%d\t{\"chips\":1,\"drinks\":2,\"tag\":\"t%d\"}\n",
+            i%num_keys, i%5)
+    }
+    return buf.Bytes()
+}
+
+func BenchmarkProcessFileSequential(b *testing.B) {
+    input := bench_input(20000, 500)
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        ctx := new(Ctx)
+        ctx.Delimiter = "\t"
+        ctx.Data = []map[string]map[string]interface{}{make(map[string]map[string]interface{})}
+        ctx.InCodec = &TSVJSONCodec{Ctx: ctx, Delimiter: ctx.Delimiter}
+
+        process_file(ctx, bytes.NewReader(input))
+    }
+}
+
+func BenchmarkProcessFileParallel(b *testing.B) {
+    input := bench_input(20000, 500)
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        ctx := new(Ctx)
+        ctx.Delimiter = "\t"
+        ctx.Data = make([]map[string]map[string]interface{}, 4)
+        for s := range ctx.Data {
+            ctx.Data[s] = make(map[string]map[string]interface{})
+        }
+        ctx.InCodec = &TSVJSONCodec{Ctx: ctx, Delimiter: ctx.Delimiter}
+
+        process_file(ctx, bytes.NewReader(input))
+    }
+}